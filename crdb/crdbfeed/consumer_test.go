@@ -0,0 +1,97 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package crdbfeed
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// countingHandler counts Columns calls across all tables; it never touches a
+// database, so it exercises Consumer's schema cache and pause/resume
+// bookkeeping without needing a live connection.
+type countingHandler struct {
+	columns     []string
+	columnCalls int
+}
+
+func (h *countingHandler) Apply(ctx context.Context, tx *sql.Tx, table string, key, after json.RawMessage) error {
+	return nil
+}
+
+func (h *countingHandler) Columns(ctx context.Context, table string) ([]string, error) {
+	h.columnCalls++
+	return h.columns, nil
+}
+
+func newTestConsumer(handler *countingHandler, opts ...Option) *Consumer {
+	// db is never dialed by the paths under test here, so a nil *sql.DB
+	// is fine: NewConsumer only stores it.
+	return NewConsumer(nil, ModeImmediate, handler, opts...)
+}
+
+func TestConsumerColumnsForCachesUntilRefresh(t *testing.T) {
+	handler := &countingHandler{columns: []string{"id"}}
+	c := newTestConsumer(handler, WithSchemaRefresh(20*time.Millisecond))
+
+	if _, err := c.columnsFor(context.Background(), "t"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.columnsFor(context.Background(), "t"); err != nil {
+		t.Fatal(err)
+	}
+	if handler.columnCalls != 1 {
+		t.Errorf("expected the cached columns to be reused, got %d Columns calls", handler.columnCalls)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if _, err := c.columnsFor(context.Background(), "t"); err != nil {
+		t.Fatal(err)
+	}
+	if handler.columnCalls != 2 {
+		t.Errorf("expected Columns to be reloaded after schemaRefresh elapsed, got %d calls", handler.columnCalls)
+	}
+}
+
+func TestConsumerPauseResume(t *testing.T) {
+	handler := &countingHandler{columns: []string{"id"}}
+	c := newTestConsumer(handler)
+
+	if c.isPaused("t") {
+		t.Fatal("expected table to not be paused initially")
+	}
+	c.pause("t")
+	if !c.isPaused("t") {
+		t.Error("expected table to be paused")
+	}
+
+	if _, err := c.columnsFor(context.Background(), "t"); err != nil {
+		t.Fatal(err)
+	}
+
+	c.Resume("t")
+	if c.isPaused("t") {
+		t.Error("expected Resume to clear the pause")
+	}
+	if _, err := c.columnsFor(context.Background(), "t"); err != nil {
+		t.Fatal(err)
+	}
+	if handler.columnCalls != 2 {
+		t.Errorf("expected Resume to force a fresh column load, got %d Columns calls", handler.columnCalls)
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package crdbfeed
+
+import "testing"
+
+func TestHasDrift(t *testing.T) {
+	batch := []Envelope{{After: []byte(`{"id": 1, "name": "a"}`)}}
+
+	drifted, err := hasDrift(batch, []string{"id", "name"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if drifted {
+		t.Error("expected no drift when target has all source columns")
+	}
+
+	drifted, err = hasDrift(batch, []string{"id"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !drifted {
+		t.Error("expected drift when target is missing a source column")
+	}
+}
+
+func TestSplitHLC(t *testing.T) {
+	wall, logical, err := splitHLC("1580511600.123456789,5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wall != "1580511600.123456789" || logical != 5 {
+		t.Errorf("got wall=%q logical=%d, want wall=%q logical=5", wall, logical, "1580511600.123456789")
+	}
+
+	wall, logical, err = splitHLC("1580511600.123456789")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wall != "1580511600.123456789" || logical != 0 {
+		t.Errorf("got wall=%q logical=%d, want wall=%q logical=0", wall, logical, "1580511600.123456789")
+	}
+
+	if _, _, err := splitHLC("1580511600.123456789,not-a-number"); err == nil {
+		t.Error("expected an error for a non-numeric logical component")
+	}
+}
+
+func TestGroupRowsByTable(t *testing.T) {
+	envelopes := []Envelope{
+		{Table: "a", Key: []byte(`1`)},
+		{Table: "b", Key: []byte(`2`)},
+		{Table: "a", Key: []byte(`3`)},
+		{Resolved: "123.0"},
+	}
+
+	byTable := groupRowsByTable(envelopes)
+	if len(byTable) != 2 {
+		t.Fatalf("expected 2 tables, got %d", len(byTable))
+	}
+	if len(byTable["a"]) != 2 {
+		t.Errorf("expected 2 rows for table a, got %d", len(byTable["a"]))
+	}
+	if len(byTable["b"]) != 1 {
+		t.Errorf("expected 1 row for table b, got %d", len(byTable["b"]))
+	}
+}
+
+func TestSortedTableNames(t *testing.T) {
+	byTable := map[string][]Envelope{
+		"zebra": {{Table: "zebra"}},
+		"alpha": {{Table: "alpha"}},
+		"mid":   {{Table: "mid"}},
+	}
+	got := sortedTableNames(byTable)
+	want := []string{"alpha", "mid", "zebra"}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("got %v, want %v", got, want)
+			break
+		}
+	}
+}
+
+func TestHasDriftIgnoresDeletes(t *testing.T) {
+	batch := []Envelope{{After: nil}}
+
+	drifted, err := hasDrift(batch, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if drifted {
+		t.Error("expected no drift for a delete (nil After)")
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package crdbfeed
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// webhookPayload mirrors the JSON body CockroachDB's webhook sink
+// posts: either a batch of row mutations or a single resolved
+// timestamp notification. The sink always POSTs these separately, one
+// or the other, but nothing in the JSON shape enforces that, so
+// WebhookHandler orders Payload rows before a Resolved notification in
+// case a single POST ever carries both.
+type webhookPayload struct {
+	Payload []struct {
+		After   json.RawMessage `json:"after"`
+		Key     json.RawMessage `json:"key"`
+		Topic   string          `json:"topic"`
+		Updated string          `json:"updated"`
+	} `json:"payload"`
+	Resolved string `json:"resolved"`
+}
+
+// WebhookHandler returns an http.Handler that decodes webhook-sink
+// JSON envelopes from the request body and hands them to c.Consume.
+// Mount it at the URI configured on the sink's
+// webhook-sink.example.com endpoint.
+func (c *Consumer) WebhookHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		defer r.Body.Close()
+
+		var body webhookPayload
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "invalid payload: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Stage any row mutations before the resolved notification so
+		// that, if a POST ever carries both, consumeResolved sees rows
+		// staged before applying the timestamp that covers them.
+		var envelopes []Envelope
+		for _, row := range body.Payload {
+			after := row.After
+			if string(after) == "null" {
+				// A delete arrives as "after": null; Envelope uses nil.
+				after = nil
+			}
+			envelopes = append(envelopes, Envelope{
+				Table:         row.Topic,
+				Key:           row.Key,
+				After:         after,
+				MVCCTimestamp: row.Updated,
+			})
+		}
+		if body.Resolved != "" {
+			envelopes = append(envelopes, Envelope{Resolved: body.Resolved})
+		}
+
+		if err := c.Consume(r.Context(), envelopes); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+}
@@ -0,0 +1,160 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package crdbfeed
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// stager persists ModeResolved envelopes in a staging table keyed by
+// (source_table, key, mvcc_timestamp) until a resolved timestamp
+// covering them arrives, and tracks the last applied checkpoint.
+type stager struct {
+	db *sql.DB
+
+	schemaOnce sync.Once
+	schemaErr  error
+}
+
+// splitHLC decomposes a CockroachDB HLC timestamp string, e.g.
+// "1580511600.123456789,5" or "1580511600.123456789", into its wall
+// time (a decimal string of seconds) and logical counter. mvcc and
+// resolved timestamps both use this format, and comparing the
+// decomposed (wall, logical) pair numerically, rather than comparing
+// the original strings lexicographically, is what makes <= ordering
+// correct: string order only happens to agree with timestamp order
+// while the integer-seconds component has a fixed digit width.
+func splitHLC(ts string) (wall string, logical int64, err error) {
+	wall, logicalStr, ok := strings.Cut(ts, ",")
+	if !ok {
+		return wall, 0, nil
+	}
+	logical, err = strconv.ParseInt(logicalStr, 10, 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("crdbfeed: invalid HLC timestamp %q: %w", ts, err)
+	}
+	return wall, logical, nil
+}
+
+func newStager(db *sql.DB) *stager {
+	return &stager{db: db}
+}
+
+// ensureSchema creates the staging and checkpoint tables the first
+// time it is called; later calls reuse that result instead of
+// re-issuing the DDL on every staged row.
+func (s *stager) ensureSchema(ctx context.Context) error {
+	s.schemaOnce.Do(func() {
+		_, s.schemaErr = s.db.ExecContext(ctx, `
+CREATE TABLE IF NOT EXISTS crdbfeed_staging (
+	source_table STRING NOT NULL,
+	key BYTES NOT NULL,
+	after BYTES,
+	mvcc_timestamp STRING NOT NULL,
+	mvcc_wall DECIMAL NOT NULL,
+	mvcc_logical INT8 NOT NULL DEFAULT 0,
+	PRIMARY KEY (source_table, key, mvcc_timestamp)
+);
+CREATE TABLE IF NOT EXISTS crdbfeed_checkpoint (
+	id INT PRIMARY KEY DEFAULT 1,
+	resolved STRING NOT NULL DEFAULT ''
+);
+`)
+	})
+	return s.schemaErr
+}
+
+// put stages a single row mutation envelope.
+func (s *stager) put(ctx context.Context, e Envelope) error {
+	if err := s.ensureSchema(ctx); err != nil {
+		return err
+	}
+	wall, logical, err := splitHLC(e.MVCCTimestamp)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `
+INSERT INTO crdbfeed_staging (source_table, key, after, mvcc_timestamp, mvcc_wall, mvcc_logical)
+VALUES ($1, $2, $3, $4, $5, $6)
+ON CONFLICT (source_table, key, mvcc_timestamp) DO UPDATE SET after = excluded.after`,
+		e.Table, []byte(e.Key), nullableBytes(e.After), e.MVCCTimestamp, wall, logical)
+	return err
+}
+
+func nullableBytes(b []byte) interface{} {
+	if b == nil {
+		return nil
+	}
+	return b
+}
+
+// upTo returns every staged envelope with mvcc_timestamp <= resolved,
+// comparing the numeric (wall, logical) decomposition of each
+// timestamp rather than the original strings, so ordering stays
+// correct regardless of the digit width of the wall-time component.
+func (s *stager) upTo(ctx context.Context, resolved string) ([]Envelope, error) {
+	if err := s.ensureSchema(ctx); err != nil {
+		return nil, err
+	}
+	wall, logical, err := splitHLC(resolved)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.db.QueryContext(ctx, `
+SELECT source_table, key, after, mvcc_timestamp FROM crdbfeed_staging
+WHERE (mvcc_wall, mvcc_logical) <= ($1, $2)`, wall, logical)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var envelopes []Envelope
+	for rows.Next() {
+		var e Envelope
+		var after []byte
+		if err := rows.Scan(&e.Table, &e.Key, &after, &e.MVCCTimestamp); err != nil {
+			return nil, err
+		}
+		if after != nil {
+			e.After = after
+		}
+		envelopes = append(envelopes, e)
+	}
+	return envelopes, rows.Err()
+}
+
+// checkpoint records resolved as the last applied timestamp and
+// removes the staged rows that are now committed, using tx so the
+// cleanup is atomic with the mutations it covers.
+func (s *stager) checkpoint(ctx context.Context, tx *sql.Tx, resolved string) error {
+	wall, logical, err := splitHLC(resolved)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx,
+		`DELETE FROM crdbfeed_staging WHERE (mvcc_wall, mvcc_logical) <= ($1, $2)`,
+		wall, logical); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+INSERT INTO crdbfeed_checkpoint (id, resolved) VALUES (1, $1)
+ON CONFLICT (id) DO UPDATE SET resolved = excluded.resolved`, resolved)
+	return err
+}
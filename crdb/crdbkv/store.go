@@ -0,0 +1,162 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package crdbkv provides a simple key/value store backed by a single
+// (path, value) table in CockroachDB, with every mutating call routed
+// through crdb.ExecuteTx so that 40001 retries are transparent to
+// callers. It is a drop-in backend for session stores, distributed
+// locks, and config stores.
+package crdbkv
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/martingallagher/cockroach-go/crdb"
+)
+
+// validTable matches the identifiers crdbkv accepts as table names:
+// WithTable is developer-supplied configuration, not end-user input,
+// but it is still interpolated into SQL text, so it is restricted to
+// a safe subset of valid CockroachDB identifiers.
+var validTable = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Store is a KV store backed by a CockroachDB table of the form
+// (path STRING PRIMARY KEY, value BYTES).
+type Store struct {
+	db    *sql.DB
+	table string
+}
+
+// Option configures a Store.
+type Option func(*Store)
+
+// WithTable overrides the default table name ("kv").
+func WithTable(name string) Option {
+	return func(s *Store) { s.table = name }
+}
+
+// NewStore returns a Store backed by db, creating its table if it does
+// not already exist.
+func NewStore(ctx context.Context, db *sql.DB, opts ...Option) (*Store, error) {
+	s := &Store{db: db, table: "kv"}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if !validTable.MatchString(s.table) {
+		return nil, fmt.Errorf("crdbkv: invalid table name %q", s.table)
+	}
+	_, err := db.ExecContext(ctx, fmt.Sprintf(
+		`CREATE TABLE IF NOT EXISTS %s (path STRING PRIMARY KEY, value BYTES NOT NULL)`,
+		s.table))
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Put upserts value at key.
+func (s *Store) Put(ctx context.Context, key string, value []byte) error {
+	return s.Transaction(ctx, func(txn Txn) error {
+		return txn.Put(ctx, key, value)
+	})
+}
+
+// Get returns the value stored at key, and false if key is unset.
+func (s *Store) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	var value []byte
+	err := s.db.QueryRowContext(ctx, fmt.Sprintf(
+		`SELECT value FROM %s WHERE path = $1`, s.table), key).Scan(&value)
+	switch err {
+	case nil:
+		return value, true, nil
+	case sql.ErrNoRows:
+		return nil, false, nil
+	default:
+		return nil, false, err
+	}
+}
+
+// Delete removes key, if present.
+func (s *Store) Delete(ctx context.Context, key string) error {
+	return s.Transaction(ctx, func(txn Txn) error {
+		return txn.Delete(ctx, key)
+	})
+}
+
+// escapeLike escapes the LIKE metacharacters %, _ and \ so that
+// prefix is matched literally.
+func escapeLike(prefix string) string {
+	r := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return r.Replace(prefix)
+}
+
+// List returns the keys having prefix, in lexicographic order.
+func (s *Store) List(ctx context.Context, prefix string) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, fmt.Sprintf(
+		`SELECT path FROM %s WHERE path LIKE $1 ESCAPE '\' ORDER BY path`, s.table),
+		escapeLike(prefix)+"%")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// Txn groups the mutations available within a single call to
+// Transaction, so that multiple keys can be updated atomically.
+type Txn interface {
+	Put(ctx context.Context, key string, value []byte) error
+	Delete(ctx context.Context, key string) error
+}
+
+type txn struct {
+	tx    *sql.Tx
+	table string
+}
+
+func (t *txn) Put(ctx context.Context, key string, value []byte) error {
+	_, err := t.tx.ExecContext(ctx, fmt.Sprintf(
+		`INSERT INTO %s (path, value) VALUES ($1, $2)
+		 ON CONFLICT (path) DO UPDATE SET value = excluded.value`, t.table),
+		key, value)
+	return err
+}
+
+func (t *txn) Delete(ctx context.Context, key string) error {
+	_, err := t.tx.ExecContext(ctx, fmt.Sprintf(
+		`DELETE FROM %s WHERE path = $1`, t.table), key)
+	return err
+}
+
+// Transaction runs fn with a Txn that atomically applies all of its
+// Put/Delete calls, retrying on serialization failures via
+// crdb.ExecuteTx.
+func (s *Store) Transaction(ctx context.Context, fn func(Txn) error) error {
+	return crdb.ExecuteTxContext(ctx, s.db, nil, func(ctx context.Context, tx *sql.Tx) error {
+		return fn(&txn{tx: tx, table: s.table})
+	})
+}
@@ -0,0 +1,49 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package crdbkv
+
+import "testing"
+
+func TestValidTable(t *testing.T) {
+	valid := []string{"kv", "_kv", "kv_store2", "KV"}
+	for _, name := range valid {
+		if !validTable.MatchString(name) {
+			t.Errorf("expected %q to be a valid table name", name)
+		}
+	}
+
+	invalid := []string{"", "2kv", "kv; DROP TABLE other", "kv store", "kv.other", "kv\""}
+	for _, name := range invalid {
+		if validTable.MatchString(name) {
+			t.Errorf("expected %q to be rejected as a table name", name)
+		}
+	}
+}
+
+func TestEscapeLike(t *testing.T) {
+	cases := []struct {
+		in, want string
+	}{
+		{"user_1", `user\_1`},
+		{"50%off", `50\%off`},
+		{`a\b`, `a\\b`},
+		{"plain", "plain"},
+	}
+	for _, c := range cases {
+		if got := escapeLike(c.in); got != c.want {
+			t.Errorf("escapeLike(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package crdbpgx provides the same SAVEPOINT cockroach_restart retry
+// helpers as the crdb package, for clients using jackc/pgx directly
+// instead of database/sql.
+package crdbpgx
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+
+	"github.com/martingallagher/cockroach-go/crdb/internal/retry"
+)
+
+// AmbiguousCommitError represents an error that occurred while
+// releasing the cockroach_restart savepoint. It is not known whether
+// the transaction succeeded; callers should decide for themselves
+// whether retrying the whole logical operation is safe.
+type AmbiguousCommitError struct {
+	error
+}
+
+// Unwrap allows errors.Is/errors.As to reach the underlying error.
+func (e *AmbiguousCommitError) Unwrap() error { return e.error }
+
+// RetryError is returned by ExecuteTx/ExecuteInTx when the retry loop
+// gives up on a retryable error without succeeding, e.g. because ctx
+// was canceled or TxOptions.MaxRetries was reached. Attempts records
+// how many times fn was called.
+type RetryError struct {
+	Attempts int
+	error
+}
+
+// Unwrap allows errors.Is/errors.As to reach the underlying error.
+func (e *RetryError) Unwrap() error { return e.error }
+
+// ErrorClassifier decides whether an error returned by a transaction
+// attempt is retryable. Install a custom implementation via
+// TxOptions.Classifier.
+type ErrorClassifier interface {
+	IsRetryable(err error) bool
+}
+
+// ErrorClassifierFunc adapts a plain function to an ErrorClassifier.
+type ErrorClassifierFunc func(err error) bool
+
+// IsRetryable implements ErrorClassifier.
+func (f ErrorClassifierFunc) IsRetryable(err error) bool { return f(err) }
+
+// DefaultErrorClassifier recognizes the classic CockroachDB
+// serialization failure (SQLSTATE 40001), and, when AmbiguousCommit is
+// set, also the ambiguous-commit error (SQLSTATE 40003).
+type DefaultErrorClassifier struct {
+	AmbiguousCommit bool
+}
+
+// IsRetryable implements ErrorClassifier.
+func (c DefaultErrorClassifier) IsRetryable(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+	if pgErr.Code == "40001" {
+		return true
+	}
+	return c.AmbiguousCommit && pgErr.Code == "40003"
+}
+
+// Conn is the subset of pgx connection-like types (*pgx.Conn,
+// *pgxpool.Pool, pgx.Tx's parent, ...) that ExecuteTx needs to begin a
+// transaction.
+type Conn interface {
+	BeginTx(ctx context.Context, txOptions pgx.TxOptions) (pgx.Tx, error)
+}
+
+// TxOptions configures the retry behavior of ExecuteTx.
+type TxOptions struct {
+	// TxOptions is passed through to conn.BeginTx.
+	TxOptions pgx.TxOptions
+	// MaxRetries bounds the number of attempts. Zero means unlimited
+	// (bounded only by ctx).
+	MaxRetries int
+	// MinBackoff and MaxBackoff bound the jittered delay between
+	// attempts. Defaults to 1ms and 200ms when left zero.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// OnRetry, when set, is called after every attempt that fails with a
+	// retryable error, with the 1-based attempt number and that error,
+	// before the retry limits are checked.
+	OnRetry func(attempt int, err error)
+	// Classifier overrides the default retryable-error detection.
+	Classifier ErrorClassifier
+}
+
+func (o *TxOptions) classifier() ErrorClassifier {
+	if o != nil && o.Classifier != nil {
+		return o.Classifier
+	}
+	return DefaultErrorClassifier{}
+}
+
+func (o *TxOptions) backoffRange() (min, max time.Duration) {
+	min, max = time.Millisecond, 200*time.Millisecond
+	if o != nil {
+		if o.MinBackoff > 0 {
+			min = o.MinBackoff
+		}
+		if o.MaxBackoff > 0 {
+			max = o.MaxBackoff
+		}
+	}
+	return min, max
+}
+
+// ExecuteTx runs fn inside a pgx transaction and retries it as needed
+// using the SAVEPOINT cockroach_restart protocol.
+func ExecuteTx(ctx context.Context, conn Conn, txOptions pgx.TxOptions, fn func(pgx.Tx) error) error {
+	return ExecuteInTx(ctx, conn, &TxOptions{TxOptions: txOptions}, fn)
+}
+
+// ExecuteInTx is like ExecuteTx but accepts a TxOptions to bound the
+// number of retries, tune backoff, observe retries, and customize
+// error classification.
+func ExecuteInTx(ctx context.Context, conn Conn, opts *TxOptions, fn func(pgx.Tx) error) error {
+	var txOptions pgx.TxOptions
+	if opts != nil {
+		txOptions = opts.TxOptions
+	}
+	tx, err := conn.BeginTx(ctx, txOptions)
+	if err != nil {
+		return err
+	}
+
+	classifier := opts.classifier()
+	minBackoff, maxBackoff := opts.backoffRange()
+
+	hooks := retry.Hooks{
+		Savepoint: func() error {
+			_, err := tx.Exec(ctx, "SAVEPOINT cockroach_restart")
+			return err
+		},
+		ReleaseSavepoint: func() error {
+			if _, err := tx.Exec(ctx, "RELEASE SAVEPOINT cockroach_restart"); err != nil {
+				return err
+			}
+			return tx.Commit(ctx)
+		},
+		RollbackToSavepoint: func() error {
+			_, err := tx.Exec(ctx, "ROLLBACK TO SAVEPOINT cockroach_restart")
+			return err
+		},
+		Rollback: func() error {
+			return tx.Rollback(ctx)
+		},
+	}
+
+	stop := func(attempt int, attemptErr error) bool {
+		if opts != nil && opts.OnRetry != nil {
+			opts.OnRetry(attempt, attemptErr)
+		}
+		if opts != nil && opts.MaxRetries > 0 && attempt >= opts.MaxRetries {
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return true
+		case <-time.After(retry.Backoff(minBackoff, maxBackoff)):
+			return false
+		}
+	}
+
+	err = retry.Execute(hooks, classifier, stop, func() error {
+		return fn(tx)
+	})
+
+	var ambiguous *retry.AmbiguousError
+	if errors.As(err, &ambiguous) {
+		return &AmbiguousCommitError{ambiguous.Err}
+	}
+	var giveUp *retry.RetryError
+	if errors.As(err, &giveUp) {
+		return &RetryError{Attempts: giveUp.Attempts, error: giveUp.Err}
+	}
+	return err
+}
@@ -0,0 +1,66 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package crdbpgx
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgconn"
+)
+
+func TestTxOptionsClassifierDefault(t *testing.T) {
+	var opts *TxOptions
+	if _, ok := opts.classifier().(DefaultErrorClassifier); !ok {
+		t.Errorf("expected a nil *TxOptions to default to DefaultErrorClassifier, got %T", opts.classifier())
+	}
+
+	custom := ErrorClassifierFunc(func(err error) bool { return true })
+	opts = &TxOptions{Classifier: custom}
+	if got := opts.classifier(); got.IsRetryable(errors.New("x")) != true {
+		t.Errorf("expected the installed Classifier to be used")
+	}
+}
+
+func TestTxOptionsBackoffRangeDefaults(t *testing.T) {
+	var opts *TxOptions
+	min, max := opts.backoffRange()
+	if min != time.Millisecond || max != 200*time.Millisecond {
+		t.Errorf("expected default backoff range [1ms, 200ms], got [%s, %s]", min, max)
+	}
+
+	opts = &TxOptions{MinBackoff: 5 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+	min, max = opts.backoffRange()
+	if min != 5*time.Millisecond || max != 50*time.Millisecond {
+		t.Errorf("expected overridden backoff range [5ms, 50ms], got [%s, %s]", min, max)
+	}
+}
+
+func TestDefaultErrorClassifierIsRetryable(t *testing.T) {
+	c := DefaultErrorClassifier{}
+	if !c.IsRetryable(&pgconn.PgError{Code: "40001"}) {
+		t.Error("expected 40001 to be retryable")
+	}
+	if c.IsRetryable(&pgconn.PgError{Code: "40003"}) {
+		t.Error("expected 40003 to not be retryable by default")
+	}
+	if !(DefaultErrorClassifier{AmbiguousCommit: true}).IsRetryable(&pgconn.PgError{Code: "40003"}) {
+		t.Error("expected 40003 to be retryable when AmbiguousCommit is set")
+	}
+	if c.IsRetryable(errors.New("not a pg error")) {
+		t.Error("expected a non-pgconn error to not be retryable")
+	}
+}
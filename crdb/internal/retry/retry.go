@@ -0,0 +1,137 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package retry implements the SAVEPOINT cockroach_restart retry
+// protocol in a driver-agnostic way, so that it can be shared between
+// the database/sql-based crdb package and driver-specific siblings
+// such as crdbpgx.
+package retry
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// Backoff picks a jittered delay in [min, max) for the wait between
+// retry attempts, falling back to min when the range is empty.
+func Backoff(min, max time.Duration) time.Duration {
+	if max <= min {
+		return min
+	}
+	return min + time.Duration(rand.Int63n(int64(max-min)))
+}
+
+// Classifier decides whether an error returned while running a
+// transaction attempt should cause the attempt to be retried.
+type Classifier interface {
+	IsRetryable(err error) bool
+}
+
+// ClassifierFunc adapts a plain function to a Classifier.
+type ClassifierFunc func(err error) bool
+
+// IsRetryable implements Classifier.
+func (f ClassifierFunc) IsRetryable(err error) bool { return f(err) }
+
+// AmbiguousError wraps an error returned while releasing the
+// cockroach_restart savepoint, i.e. at the point where the transaction
+// may or may not have committed. Callers in the driver-specific
+// packages turn this into their own exported AmbiguousCommitError type.
+type AmbiguousError struct {
+	Err error
+}
+
+// Error implements the error interface.
+func (e *AmbiguousError) Error() string { return e.Err.Error() }
+
+// Unwrap allows errors.Is/errors.As to reach the underlying error.
+func (e *AmbiguousError) Unwrap() error { return e.Err }
+
+// RetryError wraps the last classified-retryable error seen by
+// Execute when stop aborts the loop (e.g. a context was canceled, or
+// a maximum attempt count or duration was reached) before the
+// transaction succeeded. Attempts records how many times attempt was
+// called. Callers in the driver-specific packages turn this into
+// their own exported RetryError type.
+type RetryError struct {
+	Attempts int
+	Err      error
+}
+
+// Error implements the error interface.
+func (e *RetryError) Error() string {
+	return fmt.Sprintf("giving up after %d attempt(s): %s", e.Attempts, e.Err)
+}
+
+// Unwrap allows errors.Is/errors.As to reach the underlying error.
+func (e *RetryError) Unwrap() error { return e.Err }
+
+// Hooks groups the operations the retry core needs in order to drive
+// the SAVEPOINT cockroach_restart protocol without depending on a
+// specific SQL driver or transaction type.
+type Hooks struct {
+	// Savepoint establishes the retry savepoint. Called once, before
+	// the first attempt.
+	Savepoint func() error
+	// ReleaseSavepoint releases the savepoint, committing the
+	// transaction's work so far. A retryable error here is retried like
+	// any other; a non-retryable one means the commit is ambiguous, not
+	// necessarily failed, and is returned as an AmbiguousError.
+	ReleaseSavepoint func() error
+	// RollbackToSavepoint restarts the logical transaction after a
+	// retryable error, without losing the outer transaction.
+	RollbackToSavepoint func() error
+	// Rollback aborts the whole transaction. Called once, after a
+	// non-retryable error or once retries are exhausted.
+	Rollback func() error
+}
+
+// Execute drives hooks through the SAVEPOINT cockroach_restart retry
+// protocol, calling attempt for every try. stop is consulted between
+// attempts (e.g. to honor a context deadline or a maximum attempt
+// count) and, when it returns true, aborts the transaction and returns
+// the last error wrapped in a RetryError.
+func Execute(hooks Hooks, classifier Classifier, stop func(attempt int, err error) bool, attempt func() error) error {
+	if err := hooks.Savepoint(); err != nil {
+		_ = hooks.Rollback()
+		return err
+	}
+	for n := 1; ; n++ {
+		err := attempt()
+		if err == nil {
+			if releaseErr := hooks.ReleaseSavepoint(); releaseErr != nil {
+				if !classifier.IsRetryable(releaseErr) {
+					_ = hooks.Rollback()
+					return &AmbiguousError{Err: releaseErr}
+				}
+				err = releaseErr
+			} else {
+				return nil
+			}
+		} else if !classifier.IsRetryable(err) {
+			_ = hooks.Rollback()
+			return err
+		}
+
+		if stop(n, err) {
+			_ = hooks.Rollback()
+			return &RetryError{Attempts: n, Err: err}
+		}
+		if rollbackErr := hooks.RollbackToSavepoint(); rollbackErr != nil {
+			_ = hooks.Rollback()
+			return rollbackErr
+		}
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package retry
+
+import (
+	"errors"
+	"testing"
+)
+
+func fakeHooks(savepoints, releases, rollbacksToSavepoint, rollbacks *int) Hooks {
+	return Hooks{
+		Savepoint:           func() error { *savepoints++; return nil },
+		ReleaseSavepoint:    func() error { *releases++; return nil },
+		RollbackToSavepoint: func() error { *rollbacksToSavepoint++; return nil },
+		Rollback:            func() error { *rollbacks++; return nil },
+	}
+}
+
+func TestExecuteRetriesRetryableErrors(t *testing.T) {
+	var savepoints, releases, rollbacksToSavepoint, rollbacks int
+	hooks := fakeHooks(&savepoints, &releases, &rollbacksToSavepoint, &rollbacks)
+
+	retryable := errors.New("retryable")
+	attempts := 0
+	err := Execute(hooks, ClassifierFunc(func(err error) bool { return err == retryable }),
+		func(attempt int, err error) bool { return false },
+		func() error {
+			attempts++
+			if attempts < 3 {
+				return retryable
+			}
+			return nil
+		})
+
+	if err != nil {
+		t.Fatalf("expected success, got %s", err)
+	}
+	if attempts != 3 {
+		t.Errorf("expected 3 attempts, got %d", attempts)
+	}
+	if savepoints != 1 {
+		t.Errorf("expected 1 savepoint, got %d", savepoints)
+	}
+	if rollbacksToSavepoint != 2 {
+		t.Errorf("expected 2 rollbacks to savepoint, got %d", rollbacksToSavepoint)
+	}
+	if releases != 1 {
+		t.Errorf("expected 1 release, got %d", releases)
+	}
+	if rollbacks != 0 {
+		t.Errorf("expected 0 rollbacks, got %d", rollbacks)
+	}
+}
+
+func TestExecuteStopsOnNonRetryableError(t *testing.T) {
+	var savepoints, releases, rollbacksToSavepoint, rollbacks int
+	hooks := fakeHooks(&savepoints, &releases, &rollbacksToSavepoint, &rollbacks)
+
+	fatal := errors.New("fatal")
+	err := Execute(hooks, ClassifierFunc(func(err error) bool { return false }),
+		func(attempt int, err error) bool { return false },
+		func() error { return fatal })
+
+	if err != fatal {
+		t.Fatalf("expected fatal error, got %v", err)
+	}
+	if rollbacks != 1 {
+		t.Errorf("expected 1 rollback, got %d", rollbacks)
+	}
+	if releases != 0 {
+		t.Errorf("expected 0 releases, got %d", releases)
+	}
+}
+
+func TestExecuteStopGivesUpWithAttemptCount(t *testing.T) {
+	var savepoints, releases, rollbacksToSavepoint, rollbacks int
+	hooks := fakeHooks(&savepoints, &releases, &rollbacksToSavepoint, &rollbacks)
+
+	retryable := errors.New("retryable")
+	err := Execute(hooks, ClassifierFunc(func(err error) bool { return err == retryable }),
+		func(attempt int, err error) bool { return attempt >= 2 },
+		func() error { return retryable })
+
+	var giveUp *RetryError
+	if !errors.As(err, &giveUp) {
+		t.Fatalf("expected RetryError, got %v", err)
+	}
+	if giveUp.Attempts != 2 {
+		t.Errorf("expected 2 attempts, got %d", giveUp.Attempts)
+	}
+	if giveUp.Err != retryable {
+		t.Errorf("expected wrapped retryable error, got %v", giveUp.Err)
+	}
+	if rollbacks != 1 {
+		t.Errorf("expected 1 rollback, got %d", rollbacks)
+	}
+}
+
+func TestExecuteAmbiguousCommit(t *testing.T) {
+	var savepoints, releases, rollbacksToSavepoint, rollbacks int
+	hooks := fakeHooks(&savepoints, &releases, &rollbacksToSavepoint, &rollbacks)
+
+	releaseErr := errors.New("ambiguous")
+	hooks.ReleaseSavepoint = func() error { releases++; return releaseErr }
+
+	err := Execute(hooks, ClassifierFunc(func(err error) bool { return false }),
+		func(attempt int, err error) bool { return false },
+		func() error { return nil })
+
+	var ambiguous *AmbiguousError
+	if !errors.As(err, &ambiguous) {
+		t.Fatalf("expected AmbiguousError, got %v", err)
+	}
+	if ambiguous.Err != releaseErr {
+		t.Errorf("expected wrapped release error, got %v", ambiguous.Err)
+	}
+}
@@ -0,0 +1,229 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package crdb provides helpers for using CockroachDB in client
+// applications that go through database/sql.
+package crdb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/martingallagher/cockroach-go/crdb/internal/retry"
+)
+
+// AmbiguousCommitError represents an error that occurred while
+// committing a transaction. It is not known whether the transaction
+// succeeded. Callers should decide for themselves whether retrying the
+// whole logical operation is safe, based on its idempotency.
+type AmbiguousCommitError struct {
+	error
+}
+
+// Unwrap allows errors.Is/errors.As to reach the underlying error.
+func (e *AmbiguousCommitError) Unwrap() error { return e.error }
+
+func newAmbiguousCommitError(err error) *AmbiguousCommitError {
+	return &AmbiguousCommitError{err}
+}
+
+// RetryError is returned by ExecuteTxContext when the retry loop gives
+// up on a retryable error without succeeding, e.g. because ctx was
+// canceled or TxOptions.MaxRetries/MaxDuration was reached. Attempts
+// records how many times fn was called.
+type RetryError struct {
+	Attempts int
+	error
+}
+
+// Unwrap allows errors.Is/errors.As to reach the underlying error.
+func (e *RetryError) Unwrap() error { return e.error }
+
+func newRetryError(attempts int, err error) *RetryError {
+	return &RetryError{Attempts: attempts, error: err}
+}
+
+// ErrorClassifier decides whether an error returned by a transaction
+// attempt is retryable. Install a custom implementation via
+// TxOptions.Classifier to recognize additional error conditions.
+type ErrorClassifier interface {
+	IsRetryable(err error) bool
+}
+
+// ErrorClassifierFunc adapts a plain function to an ErrorClassifier.
+type ErrorClassifierFunc func(err error) bool
+
+// IsRetryable implements ErrorClassifier.
+func (f ErrorClassifierFunc) IsRetryable(err error) bool { return f(err) }
+
+// DefaultErrorClassifier recognizes the classic CockroachDB
+// serialization failure (SQLSTATE 40001), and, when AmbiguousCommit is
+// set, also the ambiguous-commit error (SQLSTATE 40003) so that it is
+// retried like any other restartable error rather than surfaced as an
+// AmbiguousCommitError.
+type DefaultErrorClassifier struct {
+	AmbiguousCommit bool
+}
+
+// IsRetryable implements ErrorClassifier.
+func (c DefaultErrorClassifier) IsRetryable(err error) bool {
+	code, ok := errCode(err)
+	if !ok {
+		return false
+	}
+	if code == "40001" {
+		return true
+	}
+	return c.AmbiguousCommit && code == "40003"
+}
+
+// errCode extracts the SQLSTATE code from a *pq.Error, unwrapping
+// intermediate wrappers.
+func errCode(err error) (string, bool) {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return string(pqErr.Code), true
+	}
+	return "", false
+}
+
+// TxOptions configures the retry behavior of ExecuteTxContext.
+type TxOptions struct {
+	// SQLOptions is passed through to db.BeginTx.
+	SQLOptions *sql.TxOptions
+	// MaxRetries bounds the number of attempts. Zero means unlimited
+	// (bounded only by ctx and MaxDuration, if set).
+	MaxRetries int
+	// MaxDuration bounds the total time spent retrying. Zero means
+	// unbounded (aside from ctx).
+	MaxDuration time.Duration
+	// MinBackoff and MaxBackoff bound the jittered delay between
+	// attempts. Defaults to 1ms and 200ms when left zero.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// OnRetry, when set, is called after every attempt that fails with a
+	// retryable error, with the 1-based attempt number and that error,
+	// before the retry limits are checked.
+	OnRetry func(attempt int, err error)
+	// Classifier overrides the default retryable-error detection.
+	Classifier ErrorClassifier
+}
+
+func (o *TxOptions) classifier() ErrorClassifier {
+	if o != nil && o.Classifier != nil {
+		return o.Classifier
+	}
+	return DefaultErrorClassifier{}
+}
+
+func (o *TxOptions) backoffRange() (min, max time.Duration) {
+	min, max = time.Millisecond, 200*time.Millisecond
+	if o != nil {
+		if o.MinBackoff > 0 {
+			min = o.MinBackoff
+		}
+		if o.MaxBackoff > 0 {
+			max = o.MaxBackoff
+		}
+	}
+	return min, max
+}
+
+// ExecuteTx runs fn inside a transaction and retries it as needed
+// using the SAVEPOINT cockroach_restart protocol. On non-retryable
+// failures the transaction is rolled back and the error returned
+// directly; on success it is committed.
+func ExecuteTx(db *sql.DB, fn func(*sql.Tx) error) error {
+	return ExecuteTxContext(context.Background(), db, nil, func(_ context.Context, tx *sql.Tx) error {
+		return fn(tx)
+	})
+}
+
+// ExecuteTxContext is like ExecuteTx but honors ctx cancellation and
+// deadlines between attempts and accepts a TxOptions to bound the
+// number of retries, tune backoff, observe retries, and customize
+// error classification.
+func ExecuteTxContext(ctx context.Context, db *sql.DB, opts *TxOptions, fn func(context.Context, *sql.Tx) error) (err error) {
+	var sqlOpts *sql.TxOptions
+	if opts != nil {
+		sqlOpts = opts.SQLOptions
+	}
+	tx, err := db.BeginTx(ctx, sqlOpts)
+	if err != nil {
+		return err
+	}
+
+	classifier := opts.classifier()
+	minBackoff, maxBackoff := opts.backoffRange()
+	start := time.Now()
+
+	hooks := retry.Hooks{
+		Savepoint: func() error {
+			_, err := tx.ExecContext(ctx, "SAVEPOINT cockroach_restart")
+			return err
+		},
+		ReleaseSavepoint: func() error {
+			if _, err := tx.ExecContext(ctx, "RELEASE SAVEPOINT cockroach_restart"); err != nil {
+				return err
+			}
+			return tx.Commit()
+		},
+		RollbackToSavepoint: func() error {
+			_, err := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT cockroach_restart")
+			return err
+		},
+		Rollback: func() error {
+			return tx.Rollback()
+		},
+	}
+
+	stop := func(attempt int, attemptErr error) bool {
+		if opts != nil && opts.OnRetry != nil {
+			opts.OnRetry(attempt, attemptErr)
+		}
+		if ctx.Err() != nil {
+			return true
+		}
+		if opts != nil && opts.MaxRetries > 0 && attempt >= opts.MaxRetries {
+			return true
+		}
+		if opts != nil && opts.MaxDuration > 0 && time.Since(start) >= opts.MaxDuration {
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return true
+		case <-time.After(retry.Backoff(minBackoff, maxBackoff)):
+			return false
+		}
+	}
+
+	err = retry.Execute(hooks, classifier, stop, func() error {
+		return fn(ctx, tx)
+	})
+
+	var ambiguous *retry.AmbiguousError
+	if errors.As(err, &ambiguous) {
+		return newAmbiguousCommitError(ambiguous.Err)
+	}
+	var giveUp *retry.RetryError
+	if errors.As(err, &giveUp) {
+		return newRetryError(giveUp.Attempts, giveUp.Err)
+	}
+	return err
+}